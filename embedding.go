@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/option"
+)
+
+// EmbeddingProvider turns chat text into a fixed-size vector for semantic
+// search (GET /chats/search, GET /chats/:id/similar) and the /admin/reindex
+// backfill. Selection mirrors LLMProvider: the EMBEDDING_PROVIDER env var,
+// default "gemini".
+type EmbeddingProvider interface {
+	// Embed returns the embedding for a single chat's text.
+	Embed(ctx context.Context, text string) ([]float32, error)
+	// EmbedBatch embeds many texts in one round trip where the backend
+	// supports it, so /admin/reindex doesn't make one request per chat.
+	EmbedBatch(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// embeddingDims is the dimensionality of the chats.embedding pgvector
+// column. Both providers below produce Google's 768-dim embedding-001
+// vectors, so the schema doesn't need to vary by provider.
+const embeddingDims = 768
+
+// newEmbeddingProvider selects a provider implementation from the
+// EMBEDDING_PROVIDER env var (default "gemini").
+func newEmbeddingProvider() (EmbeddingProvider, error) {
+	provider := envOrDefault("EMBEDDING_PROVIDER", "gemini")
+
+	switch provider {
+	case "gemini":
+		return &geminiEmbeddingProvider{apiKey: os.Getenv("GEMINI_API_KEY")}, nil
+	case "ml":
+		return &mlEmbeddingProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown EMBEDDING_PROVIDER %q (expected gemini or ml)", provider)
+	}
+}
+
+// ---- Gemini embedding-001 ----
+
+type geminiEmbeddingProvider struct {
+	apiKey string
+}
+
+func (p *geminiEmbeddingProvider) Embed(ctx context.Context, text string) ([]float32, error) {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(p.apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gemini client: %v", err)
+	}
+	defer client.Close()
+
+	resp, err := client.EmbeddingModel("embedding-001").EmbedContent(ctx, genai.Text(text))
+	if err != nil {
+		return nil, fmt.Errorf("Gemini embedding error: %v", err)
+	}
+	if resp.Embedding == nil {
+		return nil, fmt.Errorf("no embedding returned from Gemini")
+	}
+	return resp.Embedding.Values, nil
+}
+
+func (p *geminiEmbeddingProvider) EmbedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(p.apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gemini client: %v", err)
+	}
+	defer client.Close()
+
+	em := client.EmbeddingModel("embedding-001")
+	batch := em.NewBatch()
+	for _, text := range texts {
+		batch.AddContent(genai.Text(text))
+	}
+
+	resp, err := em.BatchEmbedContents(ctx, batch)
+	if err != nil {
+		return nil, fmt.Errorf("Gemini batch embedding error: %v", err)
+	}
+	if len(resp.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("Gemini returned %d embeddings for %d inputs", len(resp.Embeddings), len(texts))
+	}
+
+	vectors := make([][]float32, len(texts))
+	for i, e := range resp.Embeddings {
+		vectors[i] = e.Values
+	}
+	return vectors, nil
+}
+
+// ---- ML API /embed ----
+
+// mlEmbeddingProvider calls the same ML API the suicide-risk and sentiment
+// calls use, via its /embed endpoint. It has no native batch endpoint, so
+// EmbedBatch just calls Embed once per text.
+type mlEmbeddingProvider struct{}
+
+type embedRequest struct {
+	Text string `json:"text"`
+}
+
+type embedResponse struct {
+	Embedding []float32 `json:"embedding"`
+}
+
+func (p *mlEmbeddingProvider) Embed(ctx context.Context, text string) ([]float32, error) {
+	reqBody, err := json.Marshal(embedRequest{Text: text})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal embed request: %v", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, mlAPIURL+"/embed", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build embed request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("ML embed API error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("ML embed API returned error, status: %d, body: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var embedResp embedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&embedResp); err != nil {
+		return nil, fmt.Errorf("failed to decode ML embed response: %v", err)
+	}
+	return embedResp.Embedding, nil
+}
+
+func (p *mlEmbeddingProvider) EmbedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vec, err := p.Embed(ctx, text)
+		if err != nil {
+			return nil, err
+		}
+		vectors[i] = vec
+	}
+	return vectors, nil
+}
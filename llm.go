@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// LLMProvider is the common interface every backend (Gemini, an
+// OpenAI-compatible endpoint, Anthropic, or a self-hosted local model) must
+// implement so that processChat and processChatStream don't need to know
+// which vendor is configured. Selection happens once at startup via
+// newLLMProvider, driven by the LLM_PROVIDER and LLM_MODEL env vars.
+type LLMProvider interface {
+	// ProcessTranscript inserts '@@' speaker-change markers into text and
+	// reports whether the conversation opens with the doctor speaking. It
+	// also returns the trace of any clinical-extraction tool calls the
+	// provider made while arriving at that result (empty if the provider
+	// doesn't support tool calling).
+	ProcessTranscript(ctx context.Context, text string) (updatedText string, startWithDoctor bool, toolTrace []ToolCall, err error)
+	// Stream behaves like ProcessTranscript but invokes onDelta with partial
+	// text as it becomes available, still returning the final parsed result
+	// once the underlying call completes. Streaming responses don't carry a
+	// tool trace.
+	Stream(ctx context.Context, text string, onDelta func(chunk string)) (updatedText string, startWithDoctor bool, err error)
+}
+
+// transcriptResult is the JSON schema every provider must honor, whether it's
+// produced via native structured output or repaired out of a free-form reply.
+type transcriptResult struct {
+	UpdatedText     string `json:"updatedText"`
+	StartWithDoctor bool   `json:"startWithDoctor"`
+}
+
+// newLLMProvider selects a provider implementation from the LLM_PROVIDER env
+// var (default "gemini"), configured with LLM_MODEL and the matching
+// provider-specific API key so deployments can avoid Gemini lock-in and, for
+// "local", run fully on-prem for PHI compliance.
+func newLLMProvider() (LLMProvider, error) {
+	provider := os.Getenv("LLM_PROVIDER")
+	if provider == "" {
+		provider = "gemini"
+	}
+
+	switch provider {
+	case "gemini":
+		return &geminiProvider{
+			apiKey: os.Getenv("GEMINI_API_KEY"),
+			model:  envOrDefault("LLM_MODEL", "gemini-2.0-flash-lite-001"),
+		}, nil
+	case "openai":
+		return &openAIProvider{
+			apiKey:  os.Getenv("OPENAI_API_KEY"),
+			model:   envOrDefault("LLM_MODEL", "gpt-4o-mini"),
+			baseURL: envOrDefault("OPENAI_BASE_URL", "https://api.openai.com/v1"),
+		}, nil
+	case "anthropic":
+		return &anthropicProvider{
+			apiKey:  os.Getenv("ANTHROPIC_API_KEY"),
+			model:   envOrDefault("LLM_MODEL", "claude-3-5-sonnet-20241022"),
+			baseURL: envOrDefault("ANTHROPIC_BASE_URL", "https://api.anthropic.com"),
+		}, nil
+	case "local":
+		return &localProvider{
+			baseURL: envOrDefault("LOCAL_LLM_URL", "http://localhost:8081"),
+			model:   os.Getenv("LLM_MODEL"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown LLM_PROVIDER %q (expected gemini, openai, anthropic, or local)", provider)
+	}
+}
+
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// transcriptPrompt builds the shared instruction prompt used by every
+// provider, whether called natively (Gemini) or embedded in a chat message
+// (OpenAI, Anthropic, local).
+func transcriptPrompt(originalText string) string {
+	return fmt.Sprintf(
+		"Process the conversation below by inserting '@@' markers whenever the speaker changes. There should be a '@@' marker in every single time the speaker changes. So if person A ends his speech, there should be a '@@', then when person B ends his speech, there should be another '@@', and when person A speaks and ends his speech again, there should be another '@@', etc. Also determine if the conversation starts with a doctor. Return a JSON object with the following fields:\n"+
+			"  updatedText (string): the conversation with '@@' markers inserted,\n"+
+			"  startWithDoctor (boolean): true if the first utterance is from the doctor, false otherwise.\n"+
+			"Conversation: %s",
+		originalText,
+	)
+}
+
+// streamDoctorMarkerPrefix/Suffix bracket the one piece of structured data
+// (startWithDoctor) that the streaming prompt below asks for, so Stream can
+// pull it out of the tail of the reply without wrapping the whole dialogue
+// in JSON.
+const streamDoctorMarkerPrefix = "###DOCTOR_FIRST:"
+const streamDoctorMarkerSuffix = "###"
+
+// streamMarkerHoldback is how many trailing bytes of the growing reply are
+// withheld from onDelta at any given time, so the marker above — always the
+// last thing the model emits — never leaks into a delta as it streams in.
+const streamMarkerHoldback = len(streamDoctorMarkerPrefix) + len("false") + len(streamDoctorMarkerSuffix) + 2
+
+// streamTranscriptPrompt mirrors transcriptPrompt but asks for plain text
+// instead of a JSON envelope. Streaming a JSON-mode reply forwards raw
+// fragments of JSON syntax ("{", "\"updated", etc.) to the client instead of
+// readable dialogue, so the streaming path asks for the dialogue text
+// directly and pushes startWithDoctor into a trailing marker line instead.
+func streamTranscriptPrompt(originalText string) string {
+	return fmt.Sprintf(
+		"Process the conversation below by inserting '@@' markers whenever the speaker changes. There should be a '@@' marker in every single time the speaker changes. So if person A ends his speech, there should be a '@@', then when person B ends his speech, there should be another '@@', and when person A speaks and ends his speech again, there should be another '@@', etc.\n"+
+			"Output ONLY the updated conversation text with '@@' markers inserted — no JSON, no commentary, no code fences.\n"+
+			"After the conversation text, on its own final line, output exactly one marker: %s followed by true or false (whether the first utterance is from the doctor), followed by %s, e.g. %strue%s. Nothing may follow this marker.\n"+
+			"Conversation: %s",
+		streamDoctorMarkerPrefix, streamDoctorMarkerSuffix, streamDoctorMarkerPrefix, streamDoctorMarkerSuffix, originalText,
+	)
+}
+
+// repairTranscriptJSON extracts and decodes a transcriptResult out of a
+// provider reply that may wrap the JSON object in prose or code fences. It's
+// the fallback for providers without native structured output.
+func repairTranscriptJSON(raw string) (transcriptResult, error) {
+	var result transcriptResult
+
+	start := strings.IndexByte(raw, '{')
+	end := strings.LastIndexByte(raw, '}')
+	if start == -1 || end == -1 || end < start {
+		return result, fmt.Errorf("no JSON object found in LLM reply: %s", raw)
+	}
+
+	if err := json.Unmarshal([]byte(raw[start:end+1]), &result); err != nil {
+		return result, fmt.Errorf("failed to repair LLM JSON reply: %v", err)
+	}
+	return result, nil
+}
+
+// ---- Gemini ----
+
+type geminiProvider struct {
+	apiKey string
+	model  string
+}
+
+// maxAgentLoopIterations bounds how many times ProcessTranscript will round-trip
+// with the model before giving up, so a model that keeps calling tools instead
+// of returning a terminal result can't loop forever.
+const maxAgentLoopIterations = 8
+
+func (p *geminiProvider) newAgentModel(ctx context.Context) (*genai.Client, *genai.GenerativeModel, error) {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(p.apiKey))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create Gemini client: %v", err)
+	}
+
+	model := client.GenerativeModel(p.model)
+
+	decls := make([]*genai.FunctionDeclaration, len(registeredTools))
+	for i, t := range registeredTools {
+		decls[i] = &genai.FunctionDeclaration{
+			Name:        t.Name,
+			Description: t.Description,
+			Parameters:  jsonSchemaToGenaiSchema(t.Parameters),
+		}
+	}
+	model.Tools = []*genai.Tool{{FunctionDeclarations: decls}}
+
+	return client, model, nil
+}
+
+// ProcessTranscript drives a bounded agent loop: the model can call the
+// registered clinical-extraction tools any number of times (each dispatch
+// appended to the returned trace) before it settles on a terminal JSON
+// result matching transcriptResult.
+func (p *geminiProvider) ProcessTranscript(ctx context.Context, originalText string) (updatedText string, startWithDoctor bool, trace []ToolCall, err error) {
+	start := time.Now()
+	retries := 0
+	tokens := 0
+	defer func() {
+		recordAPICall("llm_gemini", callStatus(err), time.Since(start).Milliseconds(), retries, tokens)
+	}()
+
+	client, model, err := p.newAgentModel(ctx)
+	if err != nil {
+		return "", false, nil, err
+	}
+	defer client.Close()
+
+	cs := model.StartChat()
+
+	prompt := transcriptPrompt(originalText) +
+		"\nUse the available tools as needed to tag risk, extract medications, look up ICD-10 codes, or flag the transcript for review. " +
+		"Once you're done, respond with only the JSON object described above, no other text."
+
+	// Tool calling and Gemini's native ResponseSchema enforcement can't be used
+	// together, so a terminal reply that fails to parse as transcriptResult
+	// gets one corrective retry asking the model to resend just the JSON
+	// object before the request is failed outright.
+	jsonRetried := false
+
+	next := []genai.Part{genai.Text(prompt)}
+	for i := 0; i < maxAgentLoopIterations; i++ {
+		retries = i
+		resp, sendErr := cs.SendMessage(ctx, next...)
+		if sendErr != nil {
+			err = fmt.Errorf("LLM API error: %v", sendErr)
+			return "", false, trace, err
+		}
+		if resp.UsageMetadata != nil {
+			tokens += int(resp.UsageMetadata.TotalTokenCount)
+		}
+		if len(resp.Candidates) == 0 {
+			err = fmt.Errorf("no candidates returned from LLM")
+			return "", false, trace, err
+		}
+
+		var calls []genai.FunctionCall
+		var text string
+		for _, part := range resp.Candidates[0].Content.Parts {
+			switch p := part.(type) {
+			case genai.FunctionCall:
+				calls = append(calls, p)
+			case genai.Text:
+				text += string(p)
+			}
+		}
+
+		if len(calls) == 0 {
+			var result transcriptResult
+			result, repairErr := repairTranscriptJSON(text)
+			if repairErr != nil {
+				if !jsonRetried {
+					jsonRetried = true
+					log.Printf("LLM reply wasn't valid JSON, retrying once with a corrective prompt: %v", repairErr)
+					next = []genai.Part{genai.Text(
+						"Your last reply did not contain a valid JSON object matching " +
+							`{"updatedText": string, "startWithDoctor": boolean}` +
+							". Respond with ONLY that JSON object now, no other text.",
+					)}
+					continue
+				}
+				err = repairErr
+				return "", false, trace, err
+			}
+			return result.UpdatedText, result.StartWithDoctor, trace, nil
+		}
+
+		next = nil
+		for _, call := range calls {
+			result, callErr := dispatchTool(call.Name, call.Args)
+			argsJSON, _ := json.Marshal(call.Args)
+			trace = append(trace, ToolCall{Name: call.Name, Args: argsJSON, Result: result})
+
+			response := map[string]any{"result": result}
+			if callErr != nil {
+				response = map[string]any{"error": callErr.Error()}
+			}
+			next = append(next, genai.FunctionResponse{Name: call.Name, Response: response})
+		}
+	}
+
+	err = fmt.Errorf("agent loop exceeded %d iterations without a terminal result", maxAgentLoopIterations)
+	return "", false, trace, err
+}
+
+// dispatchTool runs the named tool's Impl against args, or reports that the
+// model requested a tool that isn't registered.
+func dispatchTool(name string, args map[string]any) (string, error) {
+	tool, ok := findTool(name)
+	if !ok {
+		return "", fmt.Errorf("unknown tool %q", name)
+	}
+	return tool.Impl(args)
+}
+
+// jsonSchemaToGenaiSchema converts the small JSON-Schema subset our tools
+// use (object/string properties) into Gemini's genai.Schema representation.
+func jsonSchemaToGenaiSchema(schema map[string]any) *genai.Schema {
+	out := &genai.Schema{Type: genai.TypeObject}
+
+	if props, ok := schema["properties"].(map[string]any); ok {
+		out.Properties = make(map[string]*genai.Schema, len(props))
+		for name, raw := range props {
+			prop, ok := raw.(map[string]any)
+			if !ok {
+				continue
+			}
+			propSchema := &genai.Schema{Type: genai.TypeString}
+			if desc, ok := prop["description"].(string); ok {
+				propSchema.Description = desc
+			}
+			out.Properties[name] = propSchema
+		}
+	}
+
+	if required, ok := schema["required"].([]string); ok {
+		out.Required = required
+	}
+
+	return out
+}
+
+// Stream uses a plain-text prompt (streamTranscriptPrompt), not the JSON-mode
+// one ProcessTranscript uses, specifically so onDelta receives readable
+// dialogue fragments instead of fragments of JSON syntax. The one piece of
+// structured data the caller needs — startWithDoctor — rides along as a
+// trailing marker line that's withheld from onDelta via streamMarkerHoldback
+// and parsed out once the stream ends.
+func (p *geminiProvider) Stream(ctx context.Context, originalText string, onDelta func(chunk string)) (string, bool, error) {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(p.apiKey))
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create Gemini client: %v", err)
+	}
+	defer client.Close()
+	model := client.GenerativeModel(p.model)
+
+	iter := model.GenerateContentStream(ctx, genai.Text(streamTranscriptPrompt(originalText)))
+
+	var full strings.Builder
+	var pending string
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", false, ctx.Err()
+			}
+			return "", false, fmt.Errorf("LLM stream error: %v", err)
+		}
+
+		if len(resp.Candidates) == 0 {
+			continue
+		}
+		for _, part := range resp.Candidates[0].Content.Parts {
+			textPart, ok := part.(genai.Text)
+			if !ok {
+				continue
+			}
+			chunk := string(textPart)
+			full.WriteString(chunk)
+			pending += chunk
+
+			if len(pending) > streamMarkerHoldback {
+				flush := pending[:len(pending)-streamMarkerHoldback]
+				pending = pending[len(pending)-streamMarkerHoldback:]
+				if onDelta != nil && flush != "" {
+					onDelta(flush)
+				}
+			}
+		}
+	}
+
+	text := full.String()
+	if text == "" {
+		return "", false, fmt.Errorf("failed to retrieve a response from LLM")
+	}
+
+	idx := strings.Index(text, streamDoctorMarkerPrefix)
+	if idx == -1 {
+		return "", false, fmt.Errorf("missing start-with-doctor marker in LLM stream reply: %s", text)
+	}
+
+	updatedText := strings.TrimRight(text[:idx], "\n")
+	marker := strings.TrimSpace(text[idx+len(streamDoctorMarkerPrefix):])
+	marker = strings.TrimSuffix(marker, streamDoctorMarkerSuffix)
+	startWithDoctor := strings.EqualFold(strings.TrimSpace(marker), "true")
+
+	return updatedText, startWithDoctor, nil
+}
+
+// ---- OpenAI-compatible (chat.completions with JSON mode) ----
+
+type openAIProvider struct {
+	apiKey  string
+	model   string
+	baseURL string
+}
+
+func (p *openAIProvider) ProcessTranscript(ctx context.Context, originalText string) (updatedText string, startWithDoctor bool, trace []ToolCall, err error) {
+	start := time.Now()
+	defer func() {
+		recordAPICall("llm_openai", callStatus(err), time.Since(start).Milliseconds(), 0, 0)
+	}()
+
+	reqBody, err := json.Marshal(map[string]any{
+		"model": p.model,
+		"messages": []map[string]string{
+			{"role": "user", "content": transcriptPrompt(originalText)},
+		},
+		"response_format": map[string]string{"type": "json_object"},
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to marshal OpenAI request: %v", err)
+		return "", false, nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/chat/completions", bytes.NewReader(reqBody))
+	if err != nil {
+		err = fmt.Errorf("failed to build OpenAI request: %v", err)
+		return "", false, nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+p.apiKey)
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		err = fmt.Errorf("OpenAI API error: %v", err)
+		return "", false, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("OpenAI API returned error, status: %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return "", false, nil, err
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		err = fmt.Errorf("failed to decode OpenAI response: %v", err)
+		return "", false, nil, err
+	}
+	if len(completion.Choices) == 0 {
+		err = fmt.Errorf("no choices returned from OpenAI")
+		return "", false, nil, err
+	}
+
+	result, err := repairTranscriptJSON(completion.Choices[0].Message.Content)
+	if err != nil {
+		return "", false, nil, err
+	}
+	return result.UpdatedText, result.StartWithDoctor, nil, nil
+}
+
+func (p *openAIProvider) Stream(ctx context.Context, originalText string, onDelta func(chunk string)) (string, bool, error) {
+	// The chat.completions JSON-mode response can't be incrementally parsed
+	// as valid JSON, so we deliver it as a single delta once it's complete.
+	updatedText, startWithDoctor, _, err := p.ProcessTranscript(ctx, originalText)
+	if err != nil {
+		return "", false, err
+	}
+	if onDelta != nil {
+		onDelta(updatedText)
+	}
+	return updatedText, startWithDoctor, nil
+}
+
+// ---- Anthropic Messages API ----
+
+type anthropicProvider struct {
+	apiKey  string
+	model   string
+	baseURL string
+}
+
+func (p *anthropicProvider) ProcessTranscript(ctx context.Context, originalText string) (updatedText string, startWithDoctor bool, trace []ToolCall, err error) {
+	start := time.Now()
+	defer func() {
+		recordAPICall("llm_anthropic", callStatus(err), time.Since(start).Milliseconds(), 0, 0)
+	}()
+
+	reqBody, err := json.Marshal(map[string]any{
+		"model":      p.model,
+		"max_tokens": 4096,
+		"messages": []map[string]string{
+			{"role": "user", "content": transcriptPrompt(originalText) + "\nRespond with only the JSON object, no other text."},
+		},
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to marshal Anthropic request: %v", err)
+		return "", false, nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/messages", bytes.NewReader(reqBody))
+	if err != nil {
+		err = fmt.Errorf("failed to build Anthropic request: %v", err)
+		return "", false, nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", p.apiKey)
+	httpReq.Header.Set("anthropic-version", "2023-06-01")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		err = fmt.Errorf("Anthropic API error: %v", err)
+		return "", false, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("Anthropic API returned error, status: %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return "", false, nil, err
+	}
+
+	var message struct {
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		err = fmt.Errorf("failed to decode Anthropic response: %v", err)
+		return "", false, nil, err
+	}
+	if len(message.Content) == 0 {
+		err = fmt.Errorf("no content returned from Anthropic")
+		return "", false, nil, err
+	}
+
+	result, err := repairTranscriptJSON(message.Content[0].Text)
+	if err != nil {
+		return "", false, nil, err
+	}
+	return result.UpdatedText, result.StartWithDoctor, nil, nil
+}
+
+func (p *anthropicProvider) Stream(ctx context.Context, originalText string, onDelta func(chunk string)) (string, bool, error) {
+	// Same constraint as the OpenAI provider: deliver the whole reply as one
+	// delta rather than attempting to stream partial, invalid JSON.
+	updatedText, startWithDoctor, _, err := p.ProcessTranscript(ctx, originalText)
+	if err != nil {
+		return "", false, err
+	}
+	if onDelta != nil {
+		onDelta(updatedText)
+	}
+	return updatedText, startWithDoctor, nil
+}
+
+// ---- Local self-hosted backend ----
+
+// localProvider targets a self-hosted model served behind a simple HTTP
+// endpoint that already speaks our transcriptResult schema natively, so no
+// JSON repair step is needed. This is the on-prem option for PHI compliance.
+type localProvider struct {
+	baseURL string
+	model   string
+}
+
+func (p *localProvider) ProcessTranscript(ctx context.Context, originalText string) (updatedText string, startWithDoctor bool, trace []ToolCall, err error) {
+	start := time.Now()
+	defer func() {
+		recordAPICall("llm_local", callStatus(err), time.Since(start).Milliseconds(), 0, 0)
+	}()
+
+	reqBody, err := json.Marshal(map[string]string{
+		"model": p.model,
+		"text":  originalText,
+		"task":  "insert_speaker_markers",
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to marshal local LLM request: %v", err)
+		return "", false, nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/process", bytes.NewReader(reqBody))
+	if err != nil {
+		err = fmt.Errorf("failed to build local LLM request: %v", err)
+		return "", false, nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		err = fmt.Errorf("local LLM backend error: %v", err)
+		return "", false, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("local LLM backend returned error, status: %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return "", false, nil, err
+	}
+
+	var result transcriptResult
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		err = fmt.Errorf("failed to decode local LLM response: %v", err)
+		return "", false, nil, err
+	}
+	return result.UpdatedText, result.StartWithDoctor, nil, nil
+}
+
+func (p *localProvider) Stream(ctx context.Context, originalText string, onDelta func(chunk string)) (string, bool, error) {
+	updatedText, startWithDoctor, _, err := p.ProcessTranscript(ctx, originalText)
+	if err != nil {
+		return "", false, err
+	}
+	if onDelta != nil {
+		onDelta(updatedText)
+	}
+	return updatedText, startWithDoctor, nil
+}
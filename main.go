@@ -10,29 +10,53 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
-
-	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/option"
+	"github.com/pgvector/pgvector-go"
 )
 
 type Chat struct {
-	ID              int       `json:"id"`
-	StartWithDoctor bool      `json:"startWithDoctor"`
-	Text            string    `json:"text"`
-	RiskScore       int       `json:"riskScore"`
-	Memo            string    `json:"memo"`
-	CreatedAt       time.Time `json:"createdAt"`
+	ID              int          `json:"id"`
+	StartWithDoctor bool         `json:"startWithDoctor"`
+	Text            string       `json:"text"`
+	RiskScore       int          `json:"riskScore"`
+	Memo            string       `json:"memo"`
+	ToolTrace       string       `json:"toolTrace,omitempty"` // JSON-encoded trace of tool calls the LLM made during the /analyze call that produced this transcript.
+	Latency         *ChatLatency `json:"latency,omitempty"`   // Per-upstream-call latency from creation; not persisted, so it's empty on reads.
+	CreatedAt       time.Time    `json:"createdAt"`
+}
+
+// ChatLatency surfaces how long each upstream ML call took while creating a
+// chat, so the frontend can flag a slow dependency instead of just a slow
+// request.
+type ChatLatency struct {
+	UtteranceScoringMs int64 `json:"utteranceScoringMs"` // Wall-clock time to score every utterance, not the sum of the individual calls.
+}
+
+// Utterance is one speaker turn of a "@@"-marked transcript (see
+// LLMProvider.ProcessTranscript), scored individually so a single alarming
+// turn isn't diluted by an otherwise calm conversation.
+type Utterance struct {
+	Index     int    `json:"index"`
+	Speaker   string `json:"speaker"`
+	Text      string `json:"text"`
+	Risk      int    `json:"risk"`
+	Sentiment string `json:"sentiment"`
+	Unscored  bool   `json:"unscored,omitempty"` // true if the ML calls for this utterance failed/timed out; Risk/Sentiment are not to be trusted.
 }
 
 var db *sql.DB
+var llmProvider LLMProvider
+var embeddingProvider EmbeddingProvider
 var mlAPIURL = "https://anymo-ml.onrender.com"
 var mlAPIMaxRetries = 3
 var mlAPIRetryDelay = 2 * time.Second
+var mlAPICallTimeout = 8 * time.Second
 
 func main() {
 	// Load .env file only in development environment (not in production)
@@ -86,6 +110,48 @@ func main() {
 	}
 	log.Println("Database table checked/created")
 
+	// Add tool_trace for existing deployments whose table predates the tool-calling agent loop.
+	_, err = db.Exec(`ALTER TABLE chats ADD COLUMN IF NOT EXISTS tool_trace JSONB`)
+	if err != nil {
+		log.Fatalf("Failed to add tool_trace column: %v", err)
+	}
+
+	// Add utterances for existing deployments whose table predates per-utterance risk scoring.
+	_, err = db.Exec(`ALTER TABLE chats ADD COLUMN IF NOT EXISTS utterances JSONB`)
+	if err != nil {
+		log.Fatalf("Failed to add utterances column: %v", err)
+	}
+
+	// Create the api_calls telemetry table if not exists
+	_, err = db.Exec(apiCallsSchema)
+	if err != nil {
+		log.Fatalf("Failed to create api_calls table: %v", err)
+	}
+	log.Println("api_calls table checked/created")
+
+	// Enable pgvector and add the embedding column + ANN index for semantic
+	// search (GET /chats/search, GET /chats/:id/similar).
+	if err := setupEmbeddingSchema(); err != nil {
+		log.Fatalf("Failed to set up embedding schema: %v", err)
+	}
+	log.Println("embedding column/index checked/created")
+
+	// LLM provider setup
+	var errLLM error
+	llmProvider, errLLM = newLLMProvider()
+	if errLLM != nil {
+		log.Fatalf("Failed to initialize LLM provider: %v", errLLM)
+	}
+	log.Printf("Using LLM provider: %s", envOrDefault("LLM_PROVIDER", "gemini"))
+
+	// Embedding provider setup
+	var errEmbedding error
+	embeddingProvider, errEmbedding = newEmbeddingProvider()
+	if errEmbedding != nil {
+		log.Fatalf("Failed to initialize embedding provider: %v", errEmbedding)
+	}
+	log.Printf("Using embedding provider: %s", envOrDefault("EMBEDDING_PROVIDER", "gemini"))
+
 	// Initialize Gin router
 	r := gin.Default()
 
@@ -103,7 +169,10 @@ func main() {
 
 	// Routes setup
 	r.GET("/chats", getChats)
+	r.GET("/chats/search", searchChats)
 	r.GET("/chats/:id", getChat)
+	r.GET("/chats/:id/similar", similarChats)
+	r.GET("/chats/:id/utterances", getChatUtterances)
 	r.POST("/chats", createChat)
 	r.PUT("/chats/:id", updateChat)
 	r.DELETE("/chats/:id", deleteChat)
@@ -111,6 +180,10 @@ func main() {
 
 	// New /analyze endpoint for conversation analysis (matching the frontend's expected JSON format)
 	r.POST("/analyze", processChat)
+	r.POST("/analyze/stream", processChatStream)
+
+	// One-shot backfill for chats created before semantic search existed.
+	r.POST("/admin/reindex", reindexEmbeddings)
 
 	// Health check endpoint
 	r.GET("/health", func(c *gin.Context) {
@@ -119,7 +192,23 @@ func main() {
 			c.JSON(500, gin.H{"status": "error", "message": fmt.Sprintf("Database connection failed: %v", err)})
 			return
 		}
-		c.JSON(200, gin.H{"status": "ok", "message": "Server is running and connected to the database"})
+
+		mlStats, err := mlAPIHealthStats()
+		if err != nil {
+			log.Printf("Error computing ML API health stats: %v", err)
+		}
+
+		geminiTokens, err := geminiTokenSpendToday()
+		if err != nil {
+			log.Printf("Error computing Gemini token spend: %v", err)
+		}
+
+		c.JSON(200, gin.H{
+			"status":            "ok",
+			"message":           "Server is running and connected to the database",
+			"mlAPI":             mlStats,
+			"geminiTokensToday": geminiTokens,
+		})
 	})
 
 	// Start server
@@ -132,7 +221,7 @@ func main() {
 }
 
 func getChats(c *gin.Context) {
-	rows, err := db.Query("SELECT id, start_with_doctor, text, risk_score, memo, created_at FROM chats ORDER BY created_at DESC")
+	rows, err := db.Query("SELECT id, start_with_doctor, text, risk_score, memo, tool_trace, created_at FROM chats ORDER BY created_at DESC")
 	if err != nil {
 		log.Printf("Error querying chats: %v", err)
 		c.JSON(500, gin.H{"error": err.Error()})
@@ -143,12 +232,16 @@ func getChats(c *gin.Context) {
 	var chats []Chat
 	for rows.Next() {
 		var chat Chat
-		err := rows.Scan(&chat.ID, &chat.StartWithDoctor, &chat.Text, &chat.RiskScore, &chat.Memo, &chat.CreatedAt)
+		var toolTrace sql.NullString
+		err := rows.Scan(&chat.ID, &chat.StartWithDoctor, &chat.Text, &chat.RiskScore, &chat.Memo, &toolTrace, &chat.CreatedAt)
 		if err != nil {
 			log.Printf("Error scanning chat row: %v", err)
 			c.JSON(500, gin.H{"error": err.Error()})
 			return
 		}
+		if toolTrace.Valid {
+			chat.ToolTrace = toolTrace.String
+		}
 		chats = append(chats, chat)
 	}
 
@@ -164,8 +257,9 @@ func getChats(c *gin.Context) {
 func getChat(c *gin.Context) {
 	id := c.Param("id")
 	var chat Chat
-	err := db.QueryRow("SELECT id, start_with_doctor, text, risk_score, memo, created_at FROM chats WHERE id = $1", id).
-		Scan(&chat.ID, &chat.StartWithDoctor, &chat.Text, &chat.RiskScore, &chat.Memo, &chat.CreatedAt)
+	var toolTrace sql.NullString
+	err := db.QueryRow("SELECT id, start_with_doctor, text, risk_score, memo, tool_trace, created_at FROM chats WHERE id = $1", id).
+		Scan(&chat.ID, &chat.StartWithDoctor, &chat.Text, &chat.RiskScore, &chat.Memo, &toolTrace, &chat.CreatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(404, gin.H{"error": "Chat not found"})
@@ -175,9 +269,45 @@ func getChat(c *gin.Context) {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
+	if toolTrace.Valid {
+		chat.ToolTrace = toolTrace.String
+	}
 	c.JSON(200, chat)
 }
 
+// getChatUtterances returns the stored per-utterance risk/sentiment scores
+// for a chat, so the frontend can render highlighted turns instead of just
+// the aggregate risk_score.
+func getChatUtterances(c *gin.Context) {
+	id := c.Param("id")
+
+	var utterancesJSON sql.NullString
+	err := db.QueryRow("SELECT utterances FROM chats WHERE id = $1", id).Scan(&utterancesJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Chat not found"})
+			return
+		}
+		log.Printf("Error retrieving utterances for chat %s: %v", id, err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !utterancesJSON.Valid {
+		c.JSON(200, []Utterance{})
+		return
+	}
+
+	var utterances []Utterance
+	if err := json.Unmarshal([]byte(utterancesJSON.String), &utterances); err != nil {
+		log.Printf("Error unmarshaling utterances for chat %s: %v", id, err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, utterances)
+}
+
 // Suicide risk analysis integration with ML API
 type SuicideRiskRequest struct {
 	Text string `json:"text"`
@@ -187,50 +317,46 @@ type SuicideRiskResponse struct {
 	Score int `json:"score"`
 }
 
-func analyzeSuicideRisk(text string) (int, error) {
-	var err error
-	var resp *http.Response
-	
+// analyzeSuicideRisk calls the ML API's suicide-risk endpoint, making up to
+// mlAPIMaxRetries attempts with a per-attempt timeout. It returns the latency of
+// the overall call (including retries) alongside the score so callers can
+// surface it and so it can be recorded in api_calls.
+func analyzeSuicideRisk(ctx context.Context, text string) (score int, latencyMs int64, err error) {
+	start := time.Now()
+	retries := 0
+	defer func() {
+		latencyMs = time.Since(start).Milliseconds()
+		recordAPICall("ml_suicide_risk", callStatus(err), latencyMs, retries, 0)
+	}()
+
 	url := fmt.Sprintf("%s/suicide-risk", mlAPIURL)
-	reqBody, err := json.Marshal(SuicideRiskRequest{Text: text})
-	if err != nil {
-		return 0, fmt.Errorf("failed to marshal suicide risk request: %v", err)
-	}
-	
-	// Retry logic for ML API requests
-	for i := 0; i < mlAPIMaxRetries; i++ {
-		resp, err = http.Post(url, "application/json", bytes.NewBuffer(reqBody))
-		if err == nil && resp.StatusCode == http.StatusOK {
-			break
-		}
-		
-		if resp != nil {
-			resp.Body.Close()
-		}
-		
-		log.Printf("ML API suicide risk request failed (attempt %d/%d): %v", i+1, mlAPIMaxRetries, err)
-		if i < mlAPIMaxRetries-1 {
-			time.Sleep(mlAPIRetryDelay)
-		}
+	reqBody, marshalErr := json.Marshal(SuicideRiskRequest{Text: text})
+	if marshalErr != nil {
+		err = fmt.Errorf("failed to marshal suicide risk request: %v", marshalErr)
+		return 0, 0, err
 	}
-	
+
+	resp, cancel, err := postWithRetry(ctx, url, reqBody, &retries)
 	if err != nil {
-		return 0, fmt.Errorf("failed to make suicide risk API request after %d attempts: %v", mlAPIMaxRetries, err)
+		err = fmt.Errorf("failed to make suicide risk API request after %d attempts: %v", mlAPIMaxRetries, err)
+		return 0, 0, err
 	}
-	
+	defer cancel()
+	defer resp.Body.Close()
+
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		return 0, fmt.Errorf("suicide risk API returned error, status: %d, body: %s", resp.StatusCode, string(bodyBytes))
+		err = fmt.Errorf("suicide risk API returned error, status: %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return 0, 0, err
 	}
-	defer resp.Body.Close()
 
 	var riskResponse SuicideRiskResponse
-	if err := json.NewDecoder(resp.Body).Decode(&riskResponse); err != nil {
-		return 0, fmt.Errorf("failed to decode suicide risk response: %v", err)
+	if decodeErr := json.NewDecoder(resp.Body).Decode(&riskResponse); decodeErr != nil {
+		err = fmt.Errorf("failed to decode suicide risk response: %v", decodeErr)
+		return 0, 0, err
 	}
 
-	return riskResponse.Score, nil
+	return riskResponse.Score, 0, nil
 }
 
 // Sentiment analysis integration with ML API
@@ -242,50 +368,236 @@ type SentimentResponse struct {
 	Sentiment string `json:"sentiment"`
 }
 
-func analyzeSentiment(text string) (string, error) {
-	var err error
-	var resp *http.Response
-	
+// analyzeSentiment calls the ML API's sentiment endpoint with the same
+// retry/timeout/telemetry behavior as analyzeSuicideRisk.
+func analyzeSentiment(ctx context.Context, text string) (sentiment string, latencyMs int64, err error) {
+	start := time.Now()
+	retries := 0
+	defer func() {
+		latencyMs = time.Since(start).Milliseconds()
+		recordAPICall("ml_sentiment", callStatus(err), latencyMs, retries, 0)
+	}()
+
 	url := fmt.Sprintf("%s/sentiment", mlAPIURL)
-	reqBody, err := json.Marshal(SentimentRequest{Text: text})
+	reqBody, marshalErr := json.Marshal(SentimentRequest{Text: text})
+	if marshalErr != nil {
+		err = fmt.Errorf("failed to marshal sentiment request: %v", marshalErr)
+		return "", 0, err
+	}
+
+	resp, cancel, err := postWithRetry(ctx, url, reqBody, &retries)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal sentiment request: %v", err)
+		err = fmt.Errorf("failed to make sentiment API request after %d attempts: %v", mlAPIMaxRetries, err)
+		return "", 0, err
 	}
-	
-	// Retry logic for ML API requests
+	defer cancel()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("sentiment API returned error, status: %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return "", 0, err
+	}
+
+	var sentimentResponse SentimentResponse
+	if decodeErr := json.NewDecoder(resp.Body).Decode(&sentimentResponse); decodeErr != nil {
+		err = fmt.Errorf("failed to decode sentiment response: %v", decodeErr)
+		return "", 0, err
+	}
+
+	return sentimentResponse.Sentiment, 0, nil
+}
+
+// postWithRetry POSTs body to url, making up to mlAPIMaxRetries attempts with
+// mlAPIRetryDelay between attempts and a mlAPICallTimeout ceiling per attempt.
+// It honors ctx cancellation both mid-request and during the retry backoff,
+// and reports the number of retries used via retries. On success the caller
+// owns the returned cancel func and must call it once it's done reading the
+// response body.
+func postWithRetry(ctx context.Context, url string, body []byte, retries *int) (*http.Response, context.CancelFunc, error) {
+	var resp *http.Response
+	var err error
+	var cancel context.CancelFunc
+
 	for i := 0; i < mlAPIMaxRetries; i++ {
-		resp, err = http.Post(url, "application/json", bytes.NewBuffer(reqBody))
+		*retries = i
+
+		var attemptCtx context.Context
+		attemptCtx, cancel = context.WithTimeout(ctx, mlAPICallTimeout)
+
+		var req *http.Request
+		req, err = http.NewRequestWithContext(attemptCtx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err = http.DefaultClient.Do(req)
 		if err == nil && resp.StatusCode == http.StatusOK {
 			break
 		}
-		
 		if resp != nil {
 			resp.Body.Close()
 		}
-		
-		log.Printf("ML API sentiment request failed (attempt %d/%d): %v", i+1, mlAPIMaxRetries, err)
+		cancel()
+
+		log.Printf("ML API request to %s failed (attempt %d/%d): %v", url, i+1, mlAPIMaxRetries, err)
 		if i < mlAPIMaxRetries-1 {
-			time.Sleep(mlAPIRetryDelay)
+			select {
+			case <-time.After(mlAPIRetryDelay):
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
 		}
 	}
-	
+
 	if err != nil {
-		return "", fmt.Errorf("failed to make sentiment API request after %d attempts: %v", mlAPIMaxRetries, err)
+		if cancel != nil {
+			cancel()
+		}
+		return nil, nil, err
 	}
-	
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		return "", fmt.Errorf("sentiment API returned error, status: %d, body: %s", resp.StatusCode, string(bodyBytes))
+	return resp, cancel, nil
+}
+
+// callStatus maps a call's error (nil or not) to the status string recorded
+// in api_calls.
+func callStatus(err error) string {
+	if err != nil {
+		return "error"
 	}
-	defer resp.Body.Close()
+	return "success"
+}
 
-	var sentimentResponse SentimentResponse
-	if err := json.NewDecoder(resp.Body).Decode(&sentimentResponse); err != nil {
-		return "", fmt.Errorf("failed to decode sentiment response: %v", err)
+// nullIfEmpty lets an empty string round-trip through a nullable column (like
+// tool_trace JSONB) as SQL NULL instead of an invalid empty-string value.
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// utteranceWorkerPoolSize bounds how many utterances are scored against the
+// ML API concurrently, so a long transcript doesn't open hundreds of
+// connections at once.
+const utteranceWorkerPoolSize = 8
+
+// utteranceTimeoutBudget is the per-batch time allowance used to size
+// createChat's context deadline: one batch is utteranceWorkerPoolSize
+// utterances scored concurrently, each doing up to two ML calls with their
+// own retries.
+const utteranceTimeoutBudget = 20 * time.Second
+
+// splitUtterances breaks a "@@"-marked transcript (see
+// LLMProvider.ProcessTranscript) into individual speaker turns, alternating
+// speaker labels starting from startWithDoctor.
+func splitUtterances(text string, startWithDoctor bool) []Utterance {
+	speakers := [2]string{"Patient", "Doctor"}
+	if startWithDoctor {
+		speakers = [2]string{"Doctor", "Patient"}
+	}
+
+	var utterances []Utterance
+	for _, part := range strings.Split(text, "@@") {
+		trimmed := strings.TrimSpace(part)
+		if trimmed == "" {
+			continue
+		}
+		index := len(utterances)
+		utterances = append(utterances, Utterance{
+			Index:   index,
+			Speaker: speakers[index%2],
+			Text:    trimmed,
+		})
+	}
+	return utterances
+}
+
+// scoreUtterances runs analyzeSuicideRisk and analyzeSentiment over every
+// utterance, fanned out across utteranceWorkerPoolSize workers sharing the
+// same retry/backoff as a single-call analysis. Utterances are written back
+// to disjoint indices of the slice, so no locking is needed between workers.
+// A single utterance's failure doesn't fail the others, but it IS marked
+// Unscored rather than silently left at Risk 0 — in a suicide-risk tool, an
+// upstream failure must never read as a confident "no risk" verdict.
+func scoreUtterances(ctx context.Context, utterances []Utterance) int64 {
+	start := time.Now()
+
+	workers := utteranceWorkerPoolSize
+	if len(utterances) < workers {
+		workers = len(utterances)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				risk, _, riskErr := analyzeSuicideRisk(ctx, utterances[i].Text)
+				if riskErr != nil {
+					log.Printf("Error analyzing suicide risk for utterance %d: %v", i, riskErr)
+					utterances[i].Unscored = true
+				} else {
+					utterances[i].Risk = risk
+				}
+
+				sentiment, _, sentimentErr := analyzeSentiment(ctx, utterances[i].Text)
+				if sentimentErr != nil {
+					log.Printf("Error analyzing sentiment for utterance %d: %v", i, sentimentErr)
+					utterances[i].Unscored = true
+				} else {
+					utterances[i].Sentiment = sentiment
+				}
+			}
+		}()
+	}
+
+	for i := range utterances {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return time.Since(start).Milliseconds()
+}
+
+// summarizeUtterances picks the highest-risk utterance among those that were
+// actually scored and returns the top-level risk score plus a memo
+// describing which turn triggered it. If any utterance failed to score, that
+// is called out in the memo regardless of the winning risk score, since a
+// failure anywhere means the top-level score can't be trusted as exhaustive.
+func summarizeUtterances(utterances []Utterance) (riskScore int, memo string) {
+	var worst *Utterance
+	unscoredCount := 0
+	for i := range utterances {
+		u := &utterances[i]
+		if u.Unscored {
+			unscoredCount++
+			continue
+		}
+		if worst == nil || u.Risk > worst.Risk {
+			worst = u
+		}
 	}
 
-	return sentimentResponse.Sentiment, nil
+	var summary string
+	switch {
+	case worst == nil:
+		summary = "No utterances could be scored (all ML calls failed)"
+	default:
+		riskScore = worst.Risk
+		summary = fmt.Sprintf("Utterance #%d (%s): sentiment %s, risk %d", worst.Index, worst.Speaker, worst.Sentiment, worst.Risk)
+	}
+
+	if unscoredCount > 0 {
+		summary = fmt.Sprintf("%s [%d/%d utterances unscored due to ML API failures]", summary, unscoredCount, len(utterances))
+	}
+
+	return riskScore, summary
 }
 
 func createChat(c *gin.Context) {
@@ -294,6 +606,7 @@ func createChat(c *gin.Context) {
 		Text            string  `json:"text"`
 		RiskScore       *int    `json:"riskScore"`
 		Memo            *string `json:"memo"`
+		ToolTrace       *string `json:"toolTrace"` // JSON-encoded tool-call trace from a prior /analyze call, if any.
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -321,43 +634,78 @@ func createChat(c *gin.Context) {
 		return
 	}
 
-	// Analyze suicide risk via ML API
-	riskScore, err := analyzeSuicideRisk(chat.Text)
-	if err != nil {
-		log.Printf("Error analyzing suicide risk: %v", err)
-		// Use manual input or default value (0) if API call fails
-		if input.RiskScore != nil {
-			chat.RiskScore = *input.RiskScore
-		} else {
-			chat.RiskScore = 0
+	// Score risk and sentiment per utterance rather than the transcript as a
+	// whole, so one alarming turn isn't diluted by an otherwise calm
+	// conversation. Untagged text (no "@@" markers) is scored as a single
+	// utterance so callers still get a risk score.
+	utterances := splitUtterances(chat.Text, chat.StartWithDoctor)
+	if len(utterances) == 0 {
+		utterances = []Utterance{{Speaker: "Unknown", Text: chat.Text}}
+	}
+
+	// The fan-out runs utteranceWorkerPoolSize utterances at a time, each
+	// doing up to two ML calls with their own retries, so the deadline has
+	// to grow with the transcript instead of staying fixed at the old
+	// single-call 15s — otherwise long transcripts (exactly the ones this
+	// feature targets) get their tail utterances force-timed-out.
+	batches := (len(utterances) + utteranceWorkerPoolSize - 1) / utteranceWorkerPoolSize
+	timeout := time.Duration(batches) * utteranceTimeoutBudget
+	if timeout < 15*time.Second {
+		timeout = 15 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	chat.Latency = &ChatLatency{}
+
+	chat.Latency.UtteranceScoringMs = scoreUtterances(ctx, utterances)
+
+	riskScore, summary := summarizeUtterances(utterances)
+	if input.RiskScore != nil {
+		allUnscored := true
+		for _, u := range utterances {
+			if !u.Unscored {
+				allUnscored = false
+				break
+			}
+		}
+		if allUnscored {
+			// Every utterance call failed; fall back to manual input rather
+			// than reporting a false "no risk" from an empty scored set.
+			riskScore = *input.RiskScore
 		}
+	}
+	chat.RiskScore = riskScore
+
+	if input.Memo != nil && *input.Memo != "" {
+		chat.Memo = fmt.Sprintf("%s | %s", summary, *input.Memo)
 	} else {
-		// Use risk score from API (overriding any manual input)
-		chat.RiskScore = riskScore
+		chat.Memo = summary
 	}
 
-	// Analyze sentiment via ML API
-	sentiment, err := analyzeSentiment(chat.Text)
+	utterancesJSON, err := json.Marshal(utterances)
 	if err != nil {
-		log.Printf("Error analyzing sentiment: %v", err)
-		// Use input memo or empty string if sentiment analysis fails
-		if input.Memo != nil {
-			chat.Memo = *input.Memo
-		} else {
-			chat.Memo = ""
-		}
+		log.Printf("Error marshaling utterances: %v", err)
+	}
+
+	if input.ToolTrace != nil {
+		chat.ToolTrace = *input.ToolTrace
+	}
+
+	// Embed the transcript for semantic search. A failed embedding call
+	// shouldn't block chat creation; the row is just left unindexed until
+	// the next /admin/reindex pass picks it up.
+	var embeddingArg any
+	vector, err := embeddingProvider.Embed(ctx, chat.Text)
+	if err != nil {
+		log.Printf("Error embedding chat text: %v", err)
 	} else {
-		// Store sentiment in memo, combine with user memo if provided
-		if input.Memo != nil && *input.Memo != "" {
-			chat.Memo = fmt.Sprintf("Sentiment: %s | %s", sentiment, *input.Memo)
-		} else {
-			chat.Memo = fmt.Sprintf("Sentiment: %s", sentiment)
-		}
+		embeddingArg = pgvector.NewVector(vector)
 	}
 
 	err = db.QueryRow(
-		"INSERT INTO chats (start_with_doctor, text, risk_score, memo, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		chat.StartWithDoctor, chat.Text, chat.RiskScore, chat.Memo, chat.CreatedAt,
+		"INSERT INTO chats (start_with_doctor, text, risk_score, memo, tool_trace, embedding, utterances, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id",
+		chat.StartWithDoctor, chat.Text, chat.RiskScore, chat.Memo, nullIfEmpty(chat.ToolTrace), embeddingArg, nullIfEmpty(string(utterancesJSON)), chat.CreatedAt,
 	).Scan(&chat.ID)
 
 	if err != nil {
@@ -476,13 +824,16 @@ type ProcessChatRequest struct {
 
 // Response payload struct
 type ProcessChatResponse struct {
-	CreatedAt       string `json:"createdAt"`
-	Text            string `json:"text"` // This will contain the updated dialogue with "@@" markers.
-	Memo            string `json:"memo"`
-	StartWithDoctor bool   `json:"startWithDoctor"` // Set based on LLM feedback.
+	CreatedAt       string     `json:"createdAt"`
+	Text            string     `json:"text"` // This will contain the updated dialogue with "@@" markers.
+	Memo            string     `json:"memo"`
+	StartWithDoctor bool       `json:"startWithDoctor"`     // Set based on LLM feedback.
+	ToolTrace       []ToolCall `json:"toolTrace,omitempty"` // Tool calls the LLM made while deriving the result, for reviewer audits.
+	LatencyMs       int64      `json:"latencyMs"`           // How long the LLM call took, so the frontend can flag a slow dependency.
 }
 
-// processChat accepts the original conversation data, calls Gemini via callLLMDirect, and returns structured output.
+// processChat accepts the original conversation data, runs it through the
+// configured LLMProvider, and returns structured output.
 func processChat(c *gin.Context) {
 	// Define the expected input structure.
 	var req struct {
@@ -496,101 +847,125 @@ func processChat(c *gin.Context) {
 		return
 	}
 
-	// Call the Gemini API using the direct REST approach.
-	updatedText, startWithDoctor, err := callLLMDirect(req.Text)
+	// Give the call a ceiling so a hung upstream doesn't block the request forever.
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	updatedText, startWithDoctor, toolTrace, err := llmProvider.ProcessTranscript(ctx, req.Text)
+	latencyMs := time.Since(start).Milliseconds()
 	if err != nil {
 		c.JSON(500, gin.H{"error": "LLM processing error: " + err.Error()})
 		return
 	}
 
 	// Build the response payload.
-	resp := struct {
-		CreatedAt       string `json:"createdAt"`
-		Text            string `json:"text"`
-		Memo            string `json:"memo"`
-		StartWithDoctor bool   `json:"startWithDoctor"`
-	}{
+	resp := ProcessChatResponse{
 		CreatedAt:       req.CreatedAt,
 		Text:            updatedText,
 		Memo:            req.Memo,
 		StartWithDoctor: startWithDoctor,
+		ToolTrace:       toolTrace,
+		LatencyMs:       latencyMs,
 	}
 
 	c.JSON(200, resp)
 }
 
-func callLLMDirect(originalText string) (string, bool, error) {
-	// Create a context with timeout for the API call.
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-
-	// Create a Gemini client using your API key.
-	// (Note: The new Gemini API client does not require a project or location.)
-	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
-	if err != nil {
-		return "", false, fmt.Errorf("failed to create Gemini client: %v", err)
-	}
-	defer client.Close()
-
-	// Instantiate the model with the desired version.
-	// (You can change the model name if needed; for example "gemini-2.0-flash" is also available.)
-	model := client.GenerativeModel("gemini-2.0-flash-lite-001")
-	// Tell the model to output JSON.
-	model.ResponseMIMEType = "application/json"
-	// Provide a JSON schema so that the model always responds with our expected format.
-	model.ResponseSchema = &genai.Schema{
-		Type: genai.TypeObject,
-		Properties: map[string]*genai.Schema{
-			"updatedText": {
-				Type: genai.TypeString,
-			},
-			"startWithDoctor": {
-				Type: genai.TypeBoolean,
-			},
-		},
-		Required: []string{"updatedText", "startWithDoctor"},
-	}
-
-	// Construct the prompt, instructing the model to process the dialogue.
-	prompt := fmt.Sprintf(
-		"Process the conversation below by inserting '@@' markers whenever the speaker changes. There should be a '@@' marker in every single time the speaker changes. So if person A ends his speech, there should be a '@@', then when person B ends his speech, there should be another '@@', and when person A speaks and ends his speech again, there should be another '@@', etc. Also determine if the conversation starts with a doctor. Return a JSON object with the following fields:\n"+
-         "  updatedText (string): the conversation with '@@' markers inserted,\n"+
-         "  startWithDoctor (boolean): true if the first utterance is from the doctor, false otherwise.\n"+
-         "Conversation: %s",
-		originalText,
-	)
-
-	// Generate content using the Gemini model.
-	respGen, err := model.GenerateContent(ctx, genai.Text(prompt))
-	if err != nil {
-		return "", false, fmt.Errorf("LLM API error: %v", err)
-	}
-
-	// Ensure that we have at least one candidate in the response.
-	if len(respGen.Candidates) == 0 {
-		return "", false, fmt.Errorf("no candidates returned from LLM")
+// processChatStream mirrors processChat but streams the LLM transcript processing
+// back to the client as Server-Sent Events instead of waiting for the full response.
+// It emits "delta" events with partial updatedText chunks as they arrive, a final
+// "result" event with the completed payload, and an "error" event on failure.
+func processChatStream(c *gin.Context) {
+	var req struct {
+		CreatedAt string `json:"createdAt"`
+		Text      string `json:"text"`
+		Memo      string `json:"memo"`
 	}
 
-	// Extract the JSON response from the first candidate.
-	var jsonResponse string
-	for _, part := range respGen.Candidates[0].Content.Parts {
-		if textPart, ok := part.(genai.Text); ok {
-			jsonResponse = string(textPart)
-			break
-		}
-	}
-	if jsonResponse == "" {
-		return "", false, fmt.Errorf("failed to retrieve JSON response from LLM")
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
 	}
 
-	// Decode the JSON response.
-	var result struct {
-		UpdatedText     string `json:"updatedText"`
-		StartWithDoctor bool   `json:"startWithDoctor"`
-	}
-	if err := json.Unmarshal([]byte(jsonResponse), &result); err != nil {
-		return "", false, fmt.Errorf("failed to decode JSON response: %v", err)
-	}
+	// Cancel the LLM call if the client disconnects mid-stream; streaming
+	// responses get a longer ceiling than the blocking endpoint since they're
+	// expected to cover long multi-turn transcripts.
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 60*time.Second)
+	defer cancel()
 
-	return result.UpdatedText, result.StartWithDoctor, nil
-}
\ No newline at end of file
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+
+	deltas := make(chan string)
+	done := make(chan struct{})
+	var updatedText string
+	var startWithDoctor bool
+	var streamErr error
+	start := time.Now()
+
+	go func() {
+		defer close(done)
+		updatedText, startWithDoctor, streamErr = llmProvider.Stream(ctx, req.Text, func(chunk string) {
+			select {
+			case deltas <- chunk:
+			case <-ctx.Done():
+			}
+		})
+		close(deltas)
+	}()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case chunk, ok := <-deltas:
+			if !ok {
+				<-done
+				if streamErr != nil {
+					c.SSEvent("error", gin.H{"error": streamErr.Error()})
+					return false
+				}
+
+				// Score risk and sentiment per utterance, same as the
+				// non-streaming /analyze path, so the two endpoints don't
+				// diverge in what they report. This runs on its own
+				// context sized to the utterance count rather than reusing
+				// the LLM-call ctx above, since scoring only starts once
+				// streaming has finished.
+				utterances := splitUtterances(updatedText, startWithDoctor)
+				if len(utterances) == 0 {
+					utterances = []Utterance{{Speaker: "Unknown", Text: updatedText}}
+				}
+				batches := (len(utterances) + utteranceWorkerPoolSize - 1) / utteranceWorkerPoolSize
+				scoreTimeout := time.Duration(batches) * utteranceTimeoutBudget
+				if scoreTimeout < 15*time.Second {
+					scoreTimeout = 15 * time.Second
+				}
+				scoreCtx, scoreCancel := context.WithTimeout(c.Request.Context(), scoreTimeout)
+				scoreUtterances(scoreCtx, utterances)
+				scoreCancel()
+				riskScore, summary := summarizeUtterances(utterances)
+
+				c.SSEvent("result", gin.H{
+					"createdAt":       req.CreatedAt,
+					"memo":            req.Memo,
+					"updatedText":     updatedText,
+					"startWithDoctor": startWithDoctor,
+					"riskScore":       riskScore,
+					"riskSummary":     summary,
+					"utterances":      utterances,
+					"latencyMs":       time.Since(start).Milliseconds(),
+				})
+				return false
+			}
+			c.SSEvent("delta", gin.H{"updatedText": chunk})
+			return true
+		case <-ctx.Done():
+			// A client disconnect has no one left to tell; a timeout does.
+			if c.Request.Context().Err() == nil {
+				c.SSEvent("error", gin.H{"error": ctx.Err().Error()})
+			}
+			return false
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pgvector/pgvector-go"
+)
+
+const defaultSearchK = 10
+
+// setupEmbeddingSchema enables pgvector, adds the chats.embedding column,
+// and builds an IVFFlat ANN index over it, so GET /chats/search and
+// GET /chats/:id/similar have something to query against.
+func setupEmbeddingSchema() error {
+	if _, err := db.Exec(`CREATE EXTENSION IF NOT EXISTS vector`); err != nil {
+		return fmt.Errorf("failed to enable vector extension: %v", err)
+	}
+
+	if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE chats ADD COLUMN IF NOT EXISTS embedding vector(%d)`, embeddingDims)); err != nil {
+		return fmt.Errorf("failed to add embedding column: %v", err)
+	}
+
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS chats_embedding_idx ON chats USING ivfflat (embedding vector_cosine_ops) WITH (lists = 100)`); err != nil {
+		return fmt.Errorf("failed to create embedding index: %v", err)
+	}
+
+	return nil
+}
+
+// ChatSearchResult is a chat returned by semantic search, annotated with its
+// cosine similarity to the query (1 = identical, -1 = opposite).
+type ChatSearchResult struct {
+	Chat
+	Score float64 `json:"score"`
+}
+
+// searchKFromQuery parses the optional k query param, defaulting to
+// defaultSearchK and rejecting anything non-positive.
+func searchKFromQuery(c *gin.Context) (int, error) {
+	kParam := c.Query("k")
+	if kParam == "" {
+		return defaultSearchK, nil
+	}
+	k, err := strconv.Atoi(kParam)
+	if err != nil || k <= 0 {
+		return 0, fmt.Errorf("k must be a positive integer")
+	}
+	return k, nil
+}
+
+// scanChatSearchResults reads every row of a query that selects the usual
+// chat columns plus a trailing similarity score.
+func scanChatSearchResults(rows *sql.Rows) ([]ChatSearchResult, error) {
+	var results []ChatSearchResult
+	for rows.Next() {
+		var r ChatSearchResult
+		var toolTrace sql.NullString
+		if err := rows.Scan(&r.ID, &r.StartWithDoctor, &r.Text, &r.RiskScore, &r.Memo, &toolTrace, &r.CreatedAt, &r.Score); err != nil {
+			return nil, err
+		}
+		if toolTrace.Valid {
+			r.ToolTrace = toolTrace.String
+		}
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// searchChats embeds the q query param and returns the top-k chats by
+// cosine similarity.
+func searchChats(c *gin.Context) {
+	q := c.Query("q")
+	if q == "" {
+		c.JSON(400, gin.H{"error": "q query parameter is required"})
+		return
+	}
+
+	k, err := searchKFromQuery(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+	defer cancel()
+
+	vector, err := embeddingProvider.Embed(ctx, q)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "embedding error: " + err.Error()})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, start_with_doctor, text, risk_score, memo, tool_trace, created_at, 1 - (embedding <=> $1) AS score
+		FROM chats
+		WHERE embedding IS NOT NULL
+		ORDER BY embedding <=> $1
+		LIMIT $2
+	`, pgvector.NewVector(vector), k)
+	if err != nil {
+		log.Printf("Error searching chats: %v", err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	results, err := scanChatSearchResults(rows)
+	if err != nil {
+		log.Printf("Error scanning search results: %v", err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, results)
+}
+
+// similarChats returns the top-k chats nearest to the given chat's own
+// embedding, excluding itself, for "patients with similar transcripts".
+func similarChats(c *gin.Context) {
+	id := c.Param("id")
+
+	k, err := searchKFromQuery(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var embeddingText sql.NullString
+	err = db.QueryRow("SELECT embedding::text FROM chats WHERE id = $1", id).Scan(&embeddingText)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Chat not found"})
+			return
+		}
+		log.Printf("Error retrieving embedding for chat %s: %v", id, err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !embeddingText.Valid {
+		c.JSON(409, gin.H{"error": "chat has not been embedded yet; run POST /admin/reindex"})
+		return
+	}
+
+	var embedding pgvector.Vector
+	if err := embedding.Parse(embeddingText.String); err != nil {
+		log.Printf("Error parsing embedding for chat %s: %v", id, err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, start_with_doctor, text, risk_score, memo, tool_trace, created_at, 1 - (embedding <=> $1) AS score
+		FROM chats
+		WHERE id != $2 AND embedding IS NOT NULL
+		ORDER BY embedding <=> $1
+		LIMIT $3
+	`, embedding, id, k)
+	if err != nil {
+		log.Printf("Error finding similar chats for %s: %v", id, err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	results, err := scanChatSearchResults(rows)
+	if err != nil {
+		log.Printf("Error scanning similar-chat results: %v", err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, results)
+}
+
+// reindexBatchSize bounds how many chats are embedded per EmbedBatch call
+// during a reindex pass.
+const reindexBatchSize = 20
+
+// reindexEmbeddings is a one-shot admin route that backfills embeddings for
+// every chat row that predates semantic search (embedding IS NULL),
+// streaming progress as Server-Sent Events so a large backlog doesn't look
+// like a hung request.
+func reindexEmbeddings(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	rows, err := db.QueryContext(ctx, "SELECT id, text FROM chats WHERE embedding IS NULL ORDER BY id")
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	type pendingChat struct {
+		id   int
+		text string
+	}
+	var pending []pendingChat
+	for rows.Next() {
+		var pc pendingChat
+		if err := rows.Scan(&pc.id, &pc.text); err != nil {
+			rows.Close()
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		pending = append(pending, pc)
+	}
+	rowErr := rows.Err()
+	rows.Close()
+	if rowErr != nil {
+		c.JSON(500, gin.H{"error": rowErr.Error()})
+		return
+	}
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+
+	total := len(pending)
+	done := 0
+	failed := 0
+
+	c.SSEvent("start", gin.H{"total": total})
+	c.Writer.Flush()
+
+	for start := 0; start < total; start += reindexBatchSize {
+		if ctx.Err() != nil {
+			return
+		}
+
+		end := start + reindexBatchSize
+		if end > total {
+			end = total
+		}
+		batch := pending[start:end]
+
+		texts := make([]string, len(batch))
+		for i, pc := range batch {
+			texts[i] = pc.text
+		}
+
+		vectors, err := embeddingProvider.EmbedBatch(ctx, texts)
+		if err != nil {
+			failed += len(batch)
+			log.Printf("Error embedding reindex batch starting at id %d: %v", batch[0].id, err)
+			c.SSEvent("progress", gin.H{"done": done + failed, "total": total, "failed": failed})
+			c.Writer.Flush()
+			continue
+		}
+
+		for i, pc := range batch {
+			_, execErr := db.ExecContext(ctx, "UPDATE chats SET embedding = $1 WHERE id = $2", pgvector.NewVector(vectors[i]), pc.id)
+			if execErr != nil {
+				failed++
+				log.Printf("Error storing embedding for chat %d: %v", pc.id, execErr)
+				continue
+			}
+			done++
+		}
+
+		c.SSEvent("progress", gin.H{"done": done + failed, "total": total, "failed": failed})
+		c.Writer.Flush()
+	}
+
+	c.SSEvent("done", gin.H{"total": total, "embedded": done, "failed": failed})
+	c.Writer.Flush()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// apiCallsSchema creates the api_calls table that backs per-upstream-call
+// telemetry (latency, retries, status, token usage) for the ML API and LLM
+// provider calls, so operators get the same visibility into those
+// dependencies that /health already gives into the database.
+const apiCallsSchema = `
+	CREATE TABLE IF NOT EXISTS api_calls (
+		id SERIAL PRIMARY KEY,
+		call_type TEXT NOT NULL,
+		status TEXT NOT NULL,
+		latency_ms INTEGER NOT NULL,
+		retry_count INTEGER NOT NULL DEFAULT 0,
+		tokens INTEGER,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)
+`
+
+// recordAPICall persists one upstream call's telemetry. It logs and swallows
+// its own errors rather than returning one, since a telemetry write failure
+// shouldn't fail the request that triggered it.
+func recordAPICall(callType, status string, latencyMs int64, retryCount, tokens int) {
+	var tokensArg any
+	if tokens > 0 {
+		tokensArg = tokens
+	}
+
+	_, err := db.Exec(
+		`INSERT INTO api_calls (call_type, status, latency_ms, retry_count, tokens) VALUES ($1, $2, $3, $4, $5)`,
+		callType, status, latencyMs, retryCount, tokensArg,
+	)
+	if err != nil {
+		log.Printf("Error recording telemetry for %s: %v", callType, err)
+	}
+}
+
+// apiCallStats is the aggregated view of api_calls exposed on /health.
+type apiCallStats struct {
+	SuccessRate float64 `json:"successRate"`
+	P50Ms       float64 `json:"p50Ms"`
+	P95Ms       float64 `json:"p95Ms"`
+	SampleSize  int     `json:"sampleSize"`
+}
+
+// mlAPIHealthStats summarizes the last 5 minutes of ML API calls (suicide
+// risk + sentiment combined) for /health.
+func mlAPIHealthStats() (apiCallStats, error) {
+	var stats apiCallStats
+	var successes int
+
+	err := db.QueryRow(`
+		SELECT
+			COUNT(*) FILTER (WHERE status = 'success'),
+			COUNT(*),
+			COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY latency_ms), 0),
+			COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY latency_ms), 0)
+		FROM api_calls
+		WHERE call_type IN ('ml_suicide_risk', 'ml_sentiment')
+		  AND created_at >= now() - interval '5 minutes'
+	`).Scan(&successes, &stats.SampleSize, &stats.P50Ms, &stats.P95Ms)
+	if err != nil {
+		return stats, err
+	}
+
+	if stats.SampleSize > 0 {
+		stats.SuccessRate = float64(successes) / float64(stats.SampleSize)
+	}
+	return stats, nil
+}
+
+// geminiTokenSpendToday sums the tokens recorded against Gemini calls since
+// midnight, for the /health token-spend counter.
+func geminiTokenSpendToday() (int, error) {
+	var tokens sql.NullInt64
+	err := db.QueryRow(`
+		SELECT SUM(tokens) FROM api_calls
+		WHERE call_type = 'llm_gemini' AND created_at >= date_trunc('day', now())
+	`).Scan(&tokens)
+	if err != nil {
+		return 0, err
+	}
+	return int(tokens.Int64), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Tool is a clinical-extraction capability the LLM can invoke during the
+// agent loop in geminiProvider.ProcessTranscript. Parameters is a JSON
+// Schema object (the same shape accepted by Gemini's FunctionDeclarations
+// and OpenAI-style function calling), kept provider-agnostic so a future
+// provider's tool support can reuse the same registry.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  map[string]any
+	Impl        func(args map[string]any) (string, error)
+}
+
+// ToolCall records one dispatched invocation during the agent loop so the
+// trace can be persisted alongside the chat row for reviewer audits.
+type ToolCall struct {
+	Name   string          `json:"name"`
+	Args   json.RawMessage `json:"args"`
+	Result string          `json:"result"`
+}
+
+// registeredTools is the toolset offered to the model on every agent-loop
+// call, built once at startup.
+var registeredTools = []Tool{
+	insertSpeakerMarkerTool(),
+	tagRiskUtteranceTool(),
+	extractMedicationMentionTool(),
+	lookupICD10Tool(),
+	flagForReviewTool(),
+}
+
+func insertSpeakerMarkerTool() Tool {
+	return Tool{
+		Name:        "insert_speaker_marker",
+		Description: "Record that a speaker change occurs immediately after the given snippet of dialogue.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"afterText": map[string]any{
+					"type":        "string",
+					"description": "The dialogue snippet that the speaker change follows.",
+				},
+			},
+			"required": []string{"afterText"},
+		},
+		Impl: func(args map[string]any) (string, error) {
+			after, _ := args["afterText"].(string)
+			return fmt.Sprintf("marker recorded after %q", truncate(after, 80)), nil
+		},
+	}
+}
+
+func tagRiskUtteranceTool() Tool {
+	return Tool{
+		Name:        "tag_risk_utterance",
+		Description: "Tag a single utterance with a qualitative risk level (low, medium, high) for later review.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"utterance": map[string]any{
+					"type":        "string",
+					"description": "The utterance being tagged.",
+				},
+				"risk": map[string]any{
+					"type":        "string",
+					"description": "One of: low, medium, high.",
+				},
+			},
+			"required": []string{"utterance", "risk"},
+		},
+		Impl: func(args map[string]any) (string, error) {
+			utterance, _ := args["utterance"].(string)
+			risk, _ := args["risk"].(string)
+			return fmt.Sprintf("tagged %q as risk=%s", truncate(utterance, 80), risk), nil
+		},
+	}
+}
+
+// knownMedications is a small seed list; a real deployment would back this
+// with an RxNorm lookup, but this is enough to demonstrate the tool.
+var knownMedications = []string{
+	"sertraline", "fluoxetine", "escitalopram", "lithium", "quetiapine",
+	"olanzapine", "lorazepam", "clonazepam", "bupropion", "venlafaxine",
+}
+
+func extractMedicationMentionTool() Tool {
+	return Tool{
+		Name:        "extract_medication_mention",
+		Description: "Scan a snippet of dialogue for mentions of known psychiatric medications.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"text": map[string]any{
+					"type":        "string",
+					"description": "The dialogue snippet to scan.",
+				},
+			},
+			"required": []string{"text"},
+		},
+		Impl: func(args map[string]any) (string, error) {
+			text, _ := args["text"].(string)
+			lower := strings.ToLower(text)
+			var found []string
+			for _, med := range knownMedications {
+				if strings.Contains(lower, med) {
+					found = append(found, med)
+				}
+			}
+			if len(found) == 0 {
+				return "no known medications found", nil
+			}
+			return "found: " + strings.Join(found, ", "), nil
+		},
+	}
+}
+
+// icd10ByTerm is a small seed lookup table; a real deployment would call out
+// to a terminology service instead of a static map.
+var icd10ByTerm = map[string]string{
+	"major depressive disorder": "F33.9",
+	"depression":                "F32.9",
+	"generalized anxiety":       "F41.1",
+	"anxiety":                   "F41.9",
+	"bipolar disorder":          "F31.9",
+	"ptsd":                      "F43.10",
+	"insomnia":                  "G47.00",
+}
+
+func lookupICD10Tool() Tool {
+	return Tool{
+		Name:        "lookup_icd10",
+		Description: "Look up the ICD-10 code for a clinical term mentioned in the transcript.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"term": map[string]any{
+					"type":        "string",
+					"description": "The clinical term to look up.",
+				},
+			},
+			"required": []string{"term"},
+		},
+		Impl: func(args map[string]any) (string, error) {
+			term, _ := args["term"].(string)
+			if code, ok := icd10ByTerm[strings.ToLower(strings.TrimSpace(term))]; ok {
+				return code, nil
+			}
+			return "no ICD-10 match found", nil
+		},
+	}
+}
+
+func flagForReviewTool() Tool {
+	return Tool{
+		Name:        "flag_for_review",
+		Description: "Flag the transcript for manual clinician review, with a short reason.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"reason": map[string]any{
+					"type":        "string",
+					"description": "Why this transcript needs manual review.",
+				},
+			},
+			"required": []string{"reason"},
+		},
+		Impl: func(args map[string]any) (string, error) {
+			reason, _ := args["reason"].(string)
+			return fmt.Sprintf("flagged for review: %s", reason), nil
+		},
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+func findTool(name string) (Tool, bool) {
+	for _, t := range registeredTools {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Tool{}, false
+}